@@ -12,30 +12,321 @@ package main
 // - rand:   Use random offsets to write each block
 // - seq:    Sequentially write blocks from start of file
 // - stream: Write random length "streams" (multiple blocks) to random offsets
+//
+// Verification defaults to scanning the whole file ("-scan=full"), but
+// "-scan=holes" uses SEEK_DATA/SEEK_HOLE to walk only the allocated extents,
+// which is much faster on large sparse files. It only reads the extents the
+// filesystem reports as data and does not check that the filesystem reports
+// holes where nothing was written. Because the extents it
+// walks can contain filesystem padding alongside our blocks, -scan=holes
+// can't always tell padding from a corrupted block with certainty the way
+// -scan=full can; use -manifest/-verify-from for an unambiguous check.
+//
+// "-manifest=path" records the offset/length/checksum of every write to a
+// JSON manifest as it happens. "-verify-from=path" skips the write phase
+// entirely and instead checks an existing file against a manifest recorded
+// by a previous run (possibly on a different host), reporting missing
+// writes, corrupted blocks, and unexpected non-zero regions separately.
+//
+// "-punch-ratio" (usable with rand/seq/punch, and defaulted on for
+// "-mode=punch"; not supported in stream mode) periodically replaces a
+// write with a hole punch or zero-range fallocate call on a previously
+// written extent instead, exercising the sparse-file
+// deallocation paths that a write-only workload never touches. Punches are
+// recorded in the manifest too, so verify knows those ranges must now read
+// back as zero.
+//
+// "-workers=N" runs N concurrent writer goroutines, each with its own RNG
+// stream seeded from the top-level seed plus worker id. By default workers
+// partition the file into disjoint offset ranges so no two workers touch
+// the same block; "-overlap" instead lets them all write across the whole
+// file, with a shared map recording the last worker to touch each block
+// (used to report how many blocks more than one worker wrote), to reproduce
+// bugs that only show up under concurrent writers to one
+// image. "-pwritev" batches each stream-mode worker's writes for a stream
+// into a single pwritev(2) call instead of one WriteAt per block.
 
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"hash/adler32"
 	"log"
 	"math/rand"
 	"os"
+	"sync"
 	"syscall"
+	"unsafe"
 )
 
+// writeRecord is one entry in a sparsefile manifest: either a write of a
+// checksummed block (Kind == "") or a hole punch/zero-range deallocation of
+// a previously written extent (Kind == "punch-hole" or "punch-zero"), which
+// must read back as zero.
+type writeRecord struct {
+	Offset   int64  `json:"offset"`
+	Length   int64  `json:"length"`
+	Checksum uint32 `json:"checksum,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+}
+
+// extent is a previously written, still block-addressable range of the
+// file, tracked so punch mode has something to deallocate.
+type extent struct {
+	offset int64
+	length int64
+}
+
+// sharedState is the state the write phase's workers touch concurrently:
+// the extents written so far (for punch mode to pick a victim from), the
+// manifest encoder, and, in -overlap mode, which worker last wrote each
+// block. All access goes through its methods, which hold mu.
+//
+// Outside -overlap, workers partition the file into disjoint ranges and
+// must never punch a block from another worker's partition, so written
+// extents are tracked per worker (writtenByWorker) rather than in one pool;
+// under -overlap there are no partitions, so a single pool (written) is
+// shared and fair game for any worker to punch.
+type sharedState struct {
+	mu              sync.Mutex
+	blockSz         int64
+	overlap         bool
+	written         []extent         // used when overlap
+	writtenByWorker map[int][]extent // worker id -> its own extents; used when !overlap
+	manifest        *json.Encoder
+	lastWriter      map[int64]int // block index -> worker id; nil unless -overlap
+	contested       map[int64]bool
+}
+
+func newSharedState(blockSz int64, manifest *json.Encoder, overlap bool) *sharedState {
+	s := &sharedState{blockSz: blockSz, manifest: manifest, overlap: overlap}
+	if overlap {
+		s.lastWriter = make(map[int64]int)
+		s.contested = make(map[int64]bool)
+	} else {
+		s.writtenByWorker = make(map[int][]extent)
+	}
+	return s
+}
+
+// write performs a single block's WriteAt and records it, holding mu across
+// both. Workers only hand off to the kernel one block at a time, so doing
+// the write and the bookkeeping as one locked step guarantees the manifest
+// ends up in the same order the blocks actually landed on disk, even when
+// several workers are writing concurrently. Without that, the manifest
+// could record worker B's write before worker A's even though A's WriteAt
+// finished last and is what a reader will actually see on disk.
+func (s *sharedState) write(f *os.File, workerID int, off int64, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := f.WriteAt(b, off); err != nil {
+		return err
+	}
+	s.recordWriteLocked(workerID, off, int64(len(b)), binary.LittleEndian.Uint32(b[len(b)-4:]))
+	return nil
+}
+
+// writeStream is write's batched counterpart for stream mode: it submits
+// bufs starting at start (via pwritev or a plain WriteAt loop) and records
+// each block, all under one lock, then returns the offset just past the
+// last block written.
+func (s *sharedState) writeStream(f *os.File, workerID int, usePwritev bool, start int64, bufs [][]byte, verbose bool) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if usePwritev {
+		if err := pwritev(int(f.Fd()), bufs, start); err != nil {
+			log.Fatal("pwritev failed:", err)
+		}
+	} else {
+		o := start
+		for _, b := range bufs {
+			if _, err := f.WriteAt(b, o); err != nil {
+				log.Fatal("write failed:", err)
+			}
+			o += int64(len(b))
+		}
+	}
+
+	o := start
+	for _, b := range bufs {
+		if verbose {
+			fmt.Printf("w: %08x %08x\n", o, len(b))
+		}
+		s.recordWriteLocked(workerID, o, int64(len(b)), binary.LittleEndian.Uint32(b[len(b)-4:]))
+		o += int64(len(b))
+	}
+	return o
+}
+
+// recordWriteLocked records a completed write of a checksummed block so
+// later punches and verification can find it, and appends it to the
+// manifest. Callers must hold mu.
+func (s *sharedState) recordWriteLocked(workerID int, off, length int64, checksum uint32) {
+	e := extent{offset: off, length: length}
+	if s.overlap {
+		s.written = append(s.written, e)
+	} else {
+		s.writtenByWorker[workerID] = append(s.writtenByWorker[workerID], e)
+	}
+	if s.lastWriter != nil {
+		block := off / s.blockSz
+		if prev, ok := s.lastWriter[block]; ok && prev != workerID {
+			s.contested[block] = true
+		}
+		s.lastWriter[block] = workerID
+	}
+	if s.manifest != nil {
+		rec := writeRecord{Offset: off, Length: length, Checksum: checksum}
+		if err := s.manifest.Encode(rec); err != nil {
+			log.Fatal("write manifest:", err)
+		}
+	}
+}
+
+// pickWritten returns a random previously written extent for punch mode to
+// deallocate, or false if nothing has been written yet. Outside -overlap,
+// it only considers workerID's own extents, so a worker can never punch a
+// block from another worker's partition.
+func (s *sharedState) pickWritten(r *rand.Rand, workerID int) (extent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pool := s.written
+	if !s.overlap {
+		pool = s.writtenByWorker[workerID]
+	}
+	if len(pool) == 0 {
+		return extent{}, false
+	}
+	return pool[r.Intn(len(pool))], true
+}
+
+// punch performs victim's Fallocate deallocation and records it in the
+// manifest, holding mu across both for the same reason write does: so the
+// manifest's punch entry can't end up ordered against a concurrent write to
+// an overlapping extent differently than the two calls actually completed.
+func (s *sharedState) punch(f *os.File, victim extent, kind string, flags uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := syscall.Fallocate(int(f.Fd()), flags, victim.offset, victim.length); err != nil {
+		return err
+	}
+	s.recordPunchLocked(victim, kind)
+	return nil
+}
+
+// recordPunchLocked appends a hole-punch/zero-range manifest entry.
+// Callers must hold mu.
+func (s *sharedState) recordPunchLocked(e extent, kind string) {
+	if s.manifest == nil {
+		return
+	}
+	if err := s.manifest.Encode(writeRecord{Offset: e.offset, Length: e.length, Kind: kind}); err != nil {
+		log.Fatal("write manifest:", err)
+	}
+}
+
+// SEEK_DATA and SEEK_HOLE are not exposed by the syscall package on all
+// platforms, so define the Linux values ourselves.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// FALLOC_FL_* flags for syscall.Fallocate, not exposed as constants by the
+// syscall package.
+const (
+	fallocFlKeepSize  = 0x01
+	fallocFlPunchHole = 0x02
+	fallocFlZeroRange = 0x10
+)
+
+// SYS_PWRITEV on linux/amd64. Not exposed by the syscall package as a
+// high-level call, so we issue it directly. On amd64 the offset is a
+// single 64-bit register argument; there's no hi/lo split like the 32-bit
+// pread64/pwrite64 calling convention needs.
+const sysPwritev = 296
+
+// pwritev submits a batch of buffers as one or more vectored writes
+// starting at offset, for stream mode's batched submission path. Like
+// File.WriteAt, it loops until every byte is written or an error occurs,
+// since a single pwritev call is allowed to write less than it was given.
+func pwritev(fd int, bufs [][]byte, offset int64) error {
+	// advanceBufs trims a short write's consumed bytes off bufs[0] in
+	// place. bufs is backed by the same array as the caller's slice, so
+	// without this copy that trim would be visible to the caller too -
+	// writeStream re-ranges over its own streamBufs right after this
+	// returns to record each block's offset/length/checksum, and would
+	// then record the trimmed (wrong) length and checksum for whichever
+	// block was mid-write when a short write happened.
+	local := make([][]byte, len(bufs))
+	copy(local, bufs)
+	bufs = local
+
+	for len(bufs) > 0 {
+		iovecs := make([]syscall.Iovec, 0, len(bufs))
+		for _, b := range bufs {
+			if len(b) == 0 {
+				continue
+			}
+			var iov syscall.Iovec
+			iov.Base = &b[0]
+			iov.SetLen(len(b))
+			iovecs = append(iovecs, iov)
+		}
+		if len(iovecs) == 0 {
+			return nil
+		}
+
+		n, _, errno := syscall.Syscall6(sysPwritev, uintptr(fd),
+			uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)),
+			uintptr(offset), 0, 0)
+		if errno != 0 {
+			return errno
+		}
+		if n == 0 {
+			return fmt.Errorf("pwritev wrote 0 bytes")
+		}
+
+		offset += int64(n)
+		bufs = advanceBufs(bufs, int(n))
+	}
+	return nil
+}
+
+// advanceBufs drops the first n bytes from bufs, splitting the first
+// remaining buffer if n lands in the middle of it.
+func advanceBufs(bufs [][]byte, n int) [][]byte {
+	for n > 0 && len(bufs) > 0 {
+		if n < len(bufs[0]) {
+			bufs[0] = bufs[0][n:]
+			return bufs
+		}
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	return bufs
+}
+
 func main() {
 	argBlockSz := flag.Int64("blocksize", 4096, "Size of 'blocks' to write")
 	argNumBlocks := flag.Int("blocks", 1000, "Number of blocks to write")
 	syncBlocks := flag.Int("sync", 0, "Call sync() every n blocks")
-	mode := flag.String("mode", "rand", "Mode: rand, seq, stream")
+	mode := flag.String("mode", "rand", "Mode: rand, seq, stream, punch")
+	punchRatio := flag.Float64("punch-ratio", 0, "Fraction of writes (rand/seq/punch; not stream) to replace with a hole punch or zero-range on a previously written extent instead; defaults to 0.2 for -mode=punch")
 	minBlocks := flag.Int("stream-min", 5, "In stream mode, minimum number of blocks")
 	maxBlocks := flag.Int("stream-max", 30, "In stream mode, maximum number of blocks")
 	fileName := flag.String("file", "disk.img", "File name to use for sparse file")
 	argFileSz := flag.Int64("size", 30*1024*1024*1024, "File size")
 	seed := flag.Int64("seed", 42, "Seed for the random number generator")
 	verbose := flag.Bool("v", false, "Enable verbose output (loads)")
+	scanMode := flag.String("scan", "full", "Verify scan mode: full, holes")
+	manifestPath := flag.String("manifest", "", "Record a JSON manifest of offset/length/checksum for each write to this path")
+	verifyFrom := flag.String("verify-from", "", "Skip the write phase and verify -file against a manifest recorded by a previous run")
+	workers := flag.Int("workers", 1, "Number of concurrent writer goroutines")
+	overlap := flag.Bool("overlap", false, "Let workers write across the whole file instead of partitioning it into disjoint ranges")
+	usePwritev := flag.Bool("pwritev", false, "In stream mode, submit each worker's stream with one pwritev(2) call instead of per-block WriteAt")
 	flag.Parse()
 
 	// Having to do pointer de-reference is tedious
@@ -56,8 +347,19 @@ func main() {
 			log.Fatal("Filesize too small")
 		}
 	}
+	if *workers < 1 {
+		log.Fatal("workers must be at least 1")
+	}
+
+	if *verifyFrom != "" {
+		verifyFromManifest(*fileName, *verifyFrom, blockSz, totalBlocks, *verbose)
+		return
+	}
 
-	r := rand.New(rand.NewSource(*seed))
+	punchRatioEff := *punchRatio
+	if *mode == "punch" && punchRatioEff == 0 {
+		punchRatioEff = 0.2
+	}
 
 	fmt.Println("Create file:", *fileName)
 	f, err := os.Create(*fileName)
@@ -72,60 +374,241 @@ func main() {
 		log.Fatal("Ftruncate:", err)
 	}
 
+	var manifestEnc *json.Encoder
+	if *manifestPath != "" {
+		mf, err := os.Create(*manifestPath)
+		if err != nil {
+			log.Fatal("create manifest:", err)
+		}
+		defer mf.Close()
+		manifestEnc = json.NewEncoder(mf)
+	}
+
+	state := newSharedState(blockSz, manifestEnc, *overlap)
+
 	fmt.Println("Write data")
+	var wg sync.WaitGroup
+	perWorker := numBlocks / *workers
+	extraBlocks := numBlocks % *workers
+	partitionBlocks := totalBlocks / int64(*workers)
+	var partitionStart int64
+	for w := 0; w < *workers; w++ {
+		blocksToWrite := perWorker
+		if w < extraBlocks {
+			blocksToWrite++
+		}
+		rangeStart, rangeBlocks := int64(0), totalBlocks
+		if !*overlap {
+			rangeStart, rangeBlocks = partitionStart, partitionBlocks
+			if w == *workers-1 {
+				// Last partition absorbs any remainder from the division.
+				rangeBlocks = totalBlocks - partitionStart
+			}
+			partitionStart += partitionBlocks
+
+			// seq writes rangeStart+i for i in [0, blocksToWrite), so letting
+			// blocksToWrite exceed rangeBlocks would write past this worker's
+			// partition into the next one's. That can happen here because
+			// blocksToWrite is divided up from -blocks while rangeBlocks is
+			// divided up from the file's totalBlocks - they only match when
+			// -blocks == totalBlocks.
+			if *mode == "seq" && int64(blocksToWrite) > rangeBlocks {
+				blocksToWrite = int(rangeBlocks)
+			}
+		}
+
+		wg.Add(1)
+		cfg := writerConfig{
+			workerID:      w,
+			seed:          *seed + int64(w),
+			mode:          *mode,
+			blockSz:       blockSz,
+			blocksToWrite: blocksToWrite,
+			rangeStart:    rangeStart,
+			rangeBlocks:   rangeBlocks,
+			minBlocks:     *minBlocks,
+			maxBlocks:     *maxBlocks,
+			punchRatio:    punchRatioEff,
+			usePwritev:    *usePwritev,
+			syncEvery:     *syncBlocks,
+			verbose:       *verbose,
+		}
+		go func() {
+			defer wg.Done()
+			runWriter(f, cfg, state)
+		}()
+	}
+	wg.Wait()
+
+	if state.contested != nil && len(state.contested) > 0 {
+		fmt.Printf("%d blocks were written by more than one worker (-overlap)\n", len(state.contested))
+	}
+
+	fmt.Println("Verify the file")
+	var count int
+	switch *scanMode {
+	case "holes":
+		count, err = verifyHoles(f, blockSz, totalBlocks, *verbose)
+		if err != nil {
+			fmt.Printf("holes scan unavailable (%v), falling back to full scan\n", err)
+			count = verifyFull(f, blockSz, totalBlocks, *verbose)
+		}
+	default:
+		count = verifyFull(f, blockSz, totalBlocks, *verbose)
+	}
+	fmt.Printf("Verified %d blocks\n", count)
+	if count > numBlocks {
+		log.Fatalf("Verified more non-zero than blocks we wrote %d > %d\n", count, numBlocks)
+	}
+}
+
+// writerConfig is the per-worker configuration for runWriter: everything a
+// worker needs to generate and write its share of blocks independently of
+// the others, aside from the shared state it coordinates through.
+type writerConfig struct {
+	workerID      int
+	seed          int64
+	mode          string
+	blockSz       int64
+	blocksToWrite int
+	rangeStart    int64 // first block index this worker may touch
+	rangeBlocks   int64 // number of blocks in this worker's range
+	minBlocks     int
+	maxBlocks     int
+	punchRatio    float64
+	usePwritev    bool
+	syncEvery     int
+	verbose       bool
+}
+
+// runWriter writes cfg.blocksToWrite blocks (or punches, per cfg.punchRatio)
+// into cfg.rangeStart/cfg.rangeBlocks using a worker-local RNG stream, and
+// is safe to run concurrently with other runWriter calls sharing the same
+// *sharedState and *os.File.
+func runWriter(f *os.File, cfg writerConfig, state *sharedState) {
+	r := rand.New(rand.NewSource(cfg.seed))
+	blockSz := cfg.blockSz
+
 	var off int64
 	var streamBlocks int64
-	for i := 0; i < numBlocks; i++ {
-		b := fillBuf(int(blockSz))
+	var streamStart int64
+	var streamBufs [][]byte
+
+	flushStream := func() {
+		if len(streamBufs) == 0 {
+			return
+		}
+		// writeStream returns the offset just past the last flushed block. A mid-stream flush
+		// (e.g. from -sync) leaves the stream open, so the next batch must
+		// start where this one ended, not back at the stream's first block.
+		streamStart = state.writeStream(f, cfg.workerID, cfg.usePwritev, streamStart, streamBufs, cfg.verbose)
+		streamBufs = streamBufs[:0]
+	}
 
-		switch *mode {
-		case "rand":
-			off = r.Int63n(totalBlocks) * blockSz
+	for i := 0; i < cfg.blocksToWrite; i++ {
+		switch cfg.mode {
+		case "rand", "punch":
+			off = (cfg.rangeStart + r.Int63n(cfg.rangeBlocks)) * blockSz
 		case "seq":
-			off = int64(i) * blockSz
+			off = (cfg.rangeStart + int64(i)) * blockSz
 		case "stream":
 			if streamBlocks == 0 {
+				flushStream()
 				// new stream
-				streamBlocks = int64(*minBlocks)
-				streamBlocks += rand.Int63n(int64(*maxBlocks - *minBlocks + 1))
+				streamBlocks = int64(cfg.minBlocks)
+				streamBlocks += r.Int63n(int64(cfg.maxBlocks - cfg.minBlocks + 1))
 				var offBlock int64
 				for {
-					offBlock = r.Int63n(totalBlocks)
-					if offBlock+streamBlocks <= totalBlocks {
+					offBlock = r.Int63n(cfg.rangeBlocks)
+					if offBlock+streamBlocks <= cfg.rangeBlocks {
 						break
 					}
 				}
-				off = offBlock * blockSz
+				off = (cfg.rangeStart + offBlock) * blockSz
+				streamStart = off
 			} else {
 				off += blockSz
 			}
 			streamBlocks--
 		}
-		if *verbose {
+
+		// Stream mode buffers a whole stream's blocks before writing them
+		// out contiguously starting at streamStart; dropping one of those
+		// blocks here without writing it would desync the buffered offsets
+		// from where flushStream actually writes them. So punching only
+		// applies to the other modes, which write each block immediately.
+		if cfg.punchRatio > 0 && cfg.mode != "stream" {
+			if victim, ok := state.pickWritten(r, cfg.workerID); ok && r.Float64() < cfg.punchRatio {
+				punchExtent(f, r, victim, state, cfg.verbose)
+				continue
+			}
+		}
+
+		b := fillBuf(int(blockSz))
+		if cfg.mode == "stream" {
+			streamBufs = append(streamBufs, b)
+			if cfg.syncEvery != 0 && i%cfg.syncEvery == 0 {
+				flushStream()
+				if err := f.Sync(); err != nil {
+					log.Fatal("write failed:", err)
+				}
+			}
+			continue
+		}
+
+		if cfg.verbose {
 			fmt.Printf("w: %08x %08x\n", off, len(b))
 		}
-		_, err := f.WriteAt(b, off)
-		if err != nil {
+		if err := state.write(f, cfg.workerID, off, b); err != nil {
 			log.Fatal("write failed:", err)
 		}
 
-		if *syncBlocks != 0 && i%*syncBlocks == 0 {
+		if cfg.syncEvery != 0 && i%cfg.syncEvery == 0 {
 			if err := f.Sync(); err != nil {
 				log.Fatal("write failed:", err)
 			}
 		}
 	}
+	flushStream()
+}
+
+// punchExtent deallocates a previously written extent using either
+// FALLOC_FL_PUNCH_HOLE or FALLOC_FL_ZERO_RANGE (chosen at random), and
+// records the punch in the manifest, if one is being kept, so verify knows
+// the extent must now read back as zero.
+func punchExtent(f *os.File, r *rand.Rand, victim extent, state *sharedState, verbose bool) {
+	op := "hole"
+	flags := uint32(fallocFlPunchHole | fallocFlKeepSize)
+	if r.Intn(2) == 1 {
+		op = "zero"
+		flags = fallocFlZeroRange
+	}
+	if verbose {
+		fmt.Printf("p: %08x %08x (%s)\n", victim.offset, victim.length, op)
+	}
 
-	fmt.Println("Verify the file")
+	kind := "punch-hole"
+	if op == "zero" {
+		kind = "punch-zero"
+	}
+	if err := state.punch(f, victim, kind, flags); err != nil {
+		log.Fatal("fallocate failed:", err)
+	}
+}
+
+// verifyFull reads every block of the file and verifies the checksum of any
+// non-zero block. This is O(file size) regardless of how much data was
+// actually written.
+func verifyFull(f *os.File, blockSz int64, totalBlocks int64, verbose bool) int {
 	b := make([]byte, blockSz)
 	empty := make([]byte, blockSz)
 	count := 0
 	for i := int64(0); i < totalBlocks; i++ {
 		off := i * blockSz
-		if *verbose {
+		if verbose {
 			fmt.Printf("r: %08x %08x\n", off, len(b))
 		}
-		_, err = f.ReadAt(b, off)
+		_, err := f.ReadAt(b, off)
 		if err != nil {
 			log.Printf("read at offset %d failed with %v", off, err)
 			continue
@@ -135,7 +618,7 @@ func main() {
 			continue
 		}
 		count++
-		if *verbose {
+		if verbose {
 			fmt.Printf("v: %08x %08x\n", off, len(b))
 		}
 		if !verifyBuf(b) {
@@ -143,10 +626,224 @@ func main() {
 			printBuf(b)
 		}
 	}
-	fmt.Printf("Verified %d blocks\n", count)
-	if count > numBlocks {
-		log.Fatalf("Verified more non-zero than blocks we wrote %d > %d\n", count, numBlocks)
+	return count
+}
+
+// verifyHoles walks the file with SEEK_DATA/SEEK_HOLE instead of reading
+// every block, so it only touches the extents the filesystem actually
+// allocated. This is O(written data) rather than O(file size). All-zero
+// blocks inside a data extent are skipped, so it does not check that the
+// filesystem reports holes where nothing was written. An ENXIO from
+// SEEK_DATA ends the walk (no data past pos); any other error from
+// syscall.Seek is returned as is, so the caller can fall back to verifyFull.
+func verifyHoles(f *os.File, blockSz int64, totalBlocks int64, verbose bool) (int, error) {
+	fd := int(f.Fd())
+	fileSz := totalBlocks * blockSz
+	b := make([]byte, blockSz)
+	empty := make([]byte, blockSz)
+	count := 0
+
+	var pos int64
+	for pos < fileSz {
+		dataOff, err := syscall.Seek(fd, pos, seekData)
+		if err != nil {
+			if err == syscall.ENXIO {
+				// No more data after pos: rest of file is a hole.
+				break
+			}
+			return count, err
+		}
+		holeOff, err := syscall.Seek(fd, dataOff, seekHole)
+		if err != nil {
+			return count, err
+		}
+
+		// Align the [dataOff, holeOff) extent to block boundaries so we
+		// verify whole blocks, then walk it one block at a time.
+		start := (dataOff / blockSz) * blockSz
+		for off := start; off < holeOff; off += blockSz {
+			i := off / blockSz
+			if i >= totalBlocks {
+				break
+			}
+			if verbose {
+				fmt.Printf("r: %08x %08x\n", off, len(b))
+			}
+			if _, err := f.ReadAt(b, off); err != nil {
+				log.Printf("read at offset %d failed with %v", off, err)
+				continue
+			}
+			if !verifyBuf(b) {
+				// A zero block is just unwritten padding inside the
+				// extent, not one of our blocks; skip it quietly. Anything
+				// else that fails the checksum is either a real block we
+				// wrote that got corrupted, or noise the filesystem left
+				// in the extent - we can't tell those apart without the
+				// manifest (see -verify-from), so report it either way.
+				if !bytes.Equal(b, empty) {
+					fmt.Printf("\nXXX: Block %d did not verify\n", i)
+					printBuf(b)
+				}
+				continue
+			}
+			count++
+			if verbose {
+				fmt.Printf("v: %08x %08x\n", off, len(b))
+			}
+		}
+
+		pos = holeOff
+	}
+
+	return count, nil
+}
+
+// verifyFromManifest verifies an existing file against a manifest recorded
+// by a previous (possibly remote) run, instead of scanning the file for
+// non-zero blocks. It reports missing writes (recorded offsets that read
+// back as zero), corrupted blocks (checksum mismatches), and unexpected
+// non-zero regions (allocated extents not covered by any manifest entry)
+// separately, and exits non-zero if any are found.
+func verifyFromManifest(path, manifestPath string, blockSz, totalBlocks int64, verbose bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal("open file:", err)
 	}
+	defer f.Close()
+
+	records, err := loadManifest(manifestPath)
+	if err != nil {
+		log.Fatal("load manifest:", err)
+	}
+	fmt.Printf("Loaded %d manifest entries\n", len(records))
+
+	// A later record for a block supersedes an earlier one (e.g. a write
+	// that gets punched afterwards), so collapse the manifest down to the
+	// last record that touched each block before checking anything.
+	final := make(map[int64]writeRecord)
+	for _, rec := range records {
+		for off := rec.Offset; off < rec.Offset+rec.Length; off += blockSz {
+			r := rec
+			r.Offset = off
+			r.Length = blockSz
+			final[off/blockSz] = r
+		}
+	}
+
+	covered := make(map[int64]bool)
+	for i := range final {
+		covered[i] = true
+	}
+
+	buf := make([]byte, blockSz)
+	zero := make([]byte, blockSz)
+	missing, corrupted := 0, 0
+	for _, rec := range final {
+		if verbose {
+			fmt.Printf("r: %08x %08x\n", rec.Offset, rec.Length)
+		}
+		if _, err := f.ReadAt(buf, rec.Offset); err != nil {
+			fmt.Printf("XXX: missing write at offset %08x: %v\n", rec.Offset, err)
+			missing++
+			continue
+		}
+
+		if rec.Kind == "punch-hole" || rec.Kind == "punch-zero" {
+			if !bytes.Equal(buf, zero) {
+				fmt.Printf("XXX: punched extent at offset %08x is not zero\n", rec.Offset)
+				corrupted++
+			}
+			continue
+		}
+
+		if bytes.Equal(buf, zero) {
+			fmt.Printf("XXX: missing write at offset %08x\n", rec.Offset)
+			missing++
+			continue
+		}
+		if !verifyBuf(buf) || binary.LittleEndian.Uint32(buf[len(buf)-4:]) != rec.Checksum {
+			fmt.Printf("XXX: corrupted block at offset %08x\n", rec.Offset)
+			corrupted++
+		}
+	}
+
+	unexpected := reportUnexpected(f, blockSz, totalBlocks, covered, verbose)
+
+	fmt.Printf("Verified %d manifest entries (%d distinct blocks): %d missing, %d corrupted, %d unexpected non-zero blocks\n",
+		len(records), len(final), missing, corrupted, unexpected)
+	if missing > 0 || corrupted > 0 || unexpected > 0 {
+		log.Fatal("manifest verification failed")
+	}
+}
+
+// loadManifest reads a manifest written by a previous write phase, which is
+// a stream of JSON writeRecord values (as produced by json.Encoder.Encode).
+func loadManifest(path string) ([]writeRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []writeRecord
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var rec writeRecord
+		if err := dec.Decode(&rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// reportUnexpected walks the allocated extents of the file with
+// SEEK_DATA/SEEK_HOLE and flags any non-zero block whose index isn't in
+// covered, i.e. data nobody recorded writing. If the filesystem doesn't
+// support SEEK_DATA, it silently skips this check rather than falling back
+// to a full scan, since a full scan is exactly what -verify-from is meant
+// to avoid.
+func reportUnexpected(f *os.File, blockSz, totalBlocks int64, covered map[int64]bool, verbose bool) int {
+	fd := int(f.Fd())
+	fileSz := totalBlocks * blockSz
+	b := make([]byte, blockSz)
+	empty := make([]byte, blockSz)
+	count := 0
+
+	var pos int64
+	for pos < fileSz {
+		dataOff, err := syscall.Seek(fd, pos, seekData)
+		if err != nil {
+			break
+		}
+		holeOff, err := syscall.Seek(fd, dataOff, seekHole)
+		if err != nil {
+			break
+		}
+
+		start := (dataOff / blockSz) * blockSz
+		for off := start; off < holeOff; off += blockSz {
+			i := off / blockSz
+			if i >= totalBlocks || covered[i] {
+				continue
+			}
+			if _, err := f.ReadAt(b, off); err != nil {
+				continue
+			}
+			if bytes.Equal(b, empty) {
+				continue
+			}
+			if verbose {
+				fmt.Printf("v: %08x %08x\n", off, len(b))
+			}
+			fmt.Printf("XXX: unexpected non-zero block at offset %08x\n", off)
+			count++
+		}
+
+		pos = holeOff
+	}
+
+	return count
 }
 
 // fillBuf creates a buffer of size n filled with random data and a 4B checksum in the last word
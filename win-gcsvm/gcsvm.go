@@ -12,6 +12,13 @@ func main() {
 	imgPath := flag.String("dir", "C:\\Program Files\\Linux Containers", "Directory with initrd.img and bootx64.efi")
 	name := flag.String("name", "", "Name of the VM (default a UUID v4)")
 	cmdLine := flag.String("cmdline", "console=ttyS0", "Kernel command line arguments")
+	planPath := flag.String("plan", "", "Path to a YAML/JSON test plan to run once the VM has booted")
+	junitPath := flag.String("junit", "", "Write a JUnit XML report of the plan's step results to this path")
+	runSparsefile := flag.Bool("run-sparsefile", false, "Run the sparsefile workload inside the VM against a scratch VHD, then re-verify it from a fresh VM")
+	scratchVhd := flag.String("scratch-vhd", "", "Host path to the scratch VHD to attach for -run-sparsefile")
+	sparsefileBin := flag.String("sparsefile-bin", "", "Host path to a linux/amd64 build of the sparsefile binary, for -run-sparsefile")
+	guestDisk := flag.String("guest-disk", "/dev/sdb", "Block device path inside the guest for the attached scratch VHD")
+	sparsefileManifest := flag.String("sparsefile-manifest", "sparsefile.manifest", "Host path to copy the sparsefile workload's manifest to")
 
 	flag.Parse()
 
@@ -39,4 +46,36 @@ func main() {
 	if err := cfg.StartUtilityVM(); err != nil {
 		logrus.Fatalf("StartUtilityVM() failed: %v", err)
 	}
+
+	if *runSparsefile {
+		sfOpts := sparsefileRunOpts{
+			ScratchVHDPath: *scratchVhd,
+			BinaryPath:     *sparsefileBin,
+			ManifestPath:   *sparsefileManifest,
+			GuestDiskPath:  *guestDisk,
+			ExtraArgs:      flag.Args(),
+		}
+		if err := runSparsefileIntegration(cfg, sfOpts); err != nil {
+			logrus.Fatalf("run-sparsefile: %v", err)
+		}
+	}
+
+	if *planPath == "" {
+		return
+	}
+
+	plan, err := loadPlan(*planPath)
+	if err != nil {
+		logrus.Fatalf("load plan %s: %v", *planPath, err)
+	}
+
+	results := runPlan(cfg, plan)
+	if *junitPath != "" {
+		if err := writeJUnit(*junitPath, results); err != nil {
+			logrus.Fatalf("write junit report: %v", err)
+		}
+	}
+	if anyFailed(results) {
+		logrus.Fatal("one or more test plan steps failed")
+	}
 }
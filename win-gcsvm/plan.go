@@ -0,0 +1,290 @@
+package main
+
+// A test plan is a sequence of steps run against a booted utility VM: mount
+// a disk, run a process inside the VM via the GCS process protocol, copy a
+// file across the vsock, snapshot guest stats, or run a set of steps in
+// parallel. Plans are YAML or JSON (selected by the -plan file's
+// extension); see Step for the fields each step type understands.
+//
+// opengcs.Config only gives us HotAddVhd/HotRemoveVhd and RunProcess to work with - there
+// is no file-copy or stats helper on the client, so upload/download/snapshot
+// are all built on top of RunProcess piping to/from a shell running in the
+// guest.
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	opengcs "github.com/Microsoft/opengcs/client"
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TestPlan is the top-level document read from -plan.
+type TestPlan struct {
+	Steps []Step `json:"steps" yaml:"steps"`
+}
+
+// Step describes one action to take against the running utility VM. Only
+// the fields relevant to Type need to be set; see the case in execStep.
+type Step struct {
+	Name string `json:"name" yaml:"name"`
+	Type string `json:"type" yaml:"type"` // mount, exec, upload, download, snapshot, parallel
+
+	// mount
+	VHDPath    string `json:"vhdPath,omitempty" yaml:"vhdPath,omitempty"`
+	Controller int    `json:"controller,omitempty" yaml:"controller,omitempty"`
+	Lun        int    `json:"lun,omitempty" yaml:"lun,omitempty"`
+	ReadOnly   bool   `json:"readOnly,omitempty" yaml:"readOnly,omitempty"`
+
+	// exec
+	Command      string `json:"command,omitempty" yaml:"command,omitempty"` // guest command line, run via sh -c
+	ExpectExit   *int   `json:"expectExit,omitempty" yaml:"expectExit,omitempty"`
+	ExpectStdout string `json:"expectStdout,omitempty" yaml:"expectStdout,omitempty"` // regex
+
+	// upload/download
+	HostPath  string `json:"hostPath,omitempty" yaml:"hostPath,omitempty"`
+	GuestPath string `json:"guestPath,omitempty" yaml:"guestPath,omitempty"`
+
+	// parallel
+	Steps []Step `json:"steps,omitempty" yaml:"steps,omitempty"`
+}
+
+// StepResult is the outcome of running one Step, used for both console
+// output and the JUnit report.
+type StepResult struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// loadPlan reads a test plan from path, as YAML unless the extension is
+// ".json".
+func loadPlan(path string) (*TestPlan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan TestPlan
+	if filepath.Ext(path) == ".json" {
+		if err := json.Unmarshal(data, &plan); err != nil {
+			return nil, fmt.Errorf("parse plan: %s", err)
+		}
+	} else if err := yaml.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("parse plan: %s", err)
+	}
+	return &plan, nil
+}
+
+// runPlan runs every top-level step in plan in order against cfg, returning
+// one StepResult per step (parallel steps contribute one result per child,
+// flattened into the same slice). It does not stop at the first failure,
+// so a single run reports everything that's broken.
+func runPlan(cfg *opengcs.Config, plan *TestPlan) []StepResult {
+	var results []StepResult
+	for _, step := range plan.Steps {
+		results = append(results, runStep(cfg, step)...)
+	}
+	return results
+}
+
+// runStep runs a single step, returning one result for it (or, for a
+// "parallel" step, one result per child step run concurrently).
+func runStep(cfg *opengcs.Config, step Step) []StepResult {
+	if step.Type == "parallel" {
+		return runParallel(cfg, step)
+	}
+
+	logrus.Infof("step %q: %s", step.Name, step.Type)
+	start := time.Now()
+	err := execStep(cfg, step)
+	result := StepResult{Name: step.Name, Duration: time.Since(start), Err: err}
+	if err != nil {
+		logrus.Errorf("step %q failed: %v", step.Name, err)
+	}
+	return []StepResult{result}
+}
+
+// runParallel runs step.Steps concurrently and collects all of their
+// results before returning. A child may itself be a "parallel" step and
+// contribute more than one result, so results are gathered per child and
+// flattened afterward rather than assuming one slot per child.
+func runParallel(cfg *opengcs.Config, step Step) []StepResult {
+	perChild := make([][]StepResult, len(step.Steps))
+	var wg sync.WaitGroup
+	for i, child := range step.Steps {
+		wg.Add(1)
+		go func(i int, child Step) {
+			defer wg.Done()
+			perChild[i] = runStep(cfg, child)
+		}(i, child)
+	}
+	wg.Wait()
+
+	var results []StepResult
+	for _, r := range perChild {
+		results = append(results, r...)
+	}
+	return results
+}
+
+// execStep performs the action described by step against cfg.
+func execStep(cfg *opengcs.Config, step Step) error {
+	switch step.Type {
+	case "mount":
+		return cfg.HotAddVhd(step.VHDPath, step.Controller, step.Lun, step.ReadOnly)
+	case "exec":
+		return execProcess(cfg, step)
+	case "upload":
+		return copyFileToGuest(cfg, step.HostPath, step.GuestPath)
+	case "download":
+		return copyFileFromGuest(cfg, step.GuestPath, step.HostPath)
+	case "snapshot":
+		return snapshotStats(cfg, step.Name)
+	default:
+		return fmt.Errorf("unknown step type %q", step.Type)
+	}
+}
+
+// execProcess runs step.Command inside the utility VM over the GCS process
+// protocol and checks its exit code and stdout against the step's
+// expectations, if any were given.
+func execProcess(cfg *opengcs.Config, step Step) error {
+	var stdout bytes.Buffer
+	exitCode, err := cfg.RunProcess(fmt.Sprintf("sh -c '%s'", step.Command), nil, &stdout, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("run process: %s", err)
+	}
+
+	if step.ExpectExit != nil && int(exitCode) != *step.ExpectExit {
+		return fmt.Errorf("exit code %d, want %d", exitCode, *step.ExpectExit)
+	}
+	if step.ExpectStdout != "" {
+		matched, err := regexp.Match(step.ExpectStdout, stdout.Bytes())
+		if err != nil {
+			return fmt.Errorf("compile expectStdout regex: %s", err)
+		}
+		if !matched {
+			return fmt.Errorf("stdout did not match %q:\n%s", step.ExpectStdout, stdout.String())
+		}
+	}
+	return nil
+}
+
+// copyFileToGuest streams hostPath's contents to cfg's utility VM and
+// writes them to guestPath, using a guest shell as the write end since
+// opengcs.Config has no dedicated file-copy call.
+func copyFileToGuest(cfg *opengcs.Config, hostPath, guestPath string) error {
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return fmt.Errorf("open %s: %s", hostPath, err)
+	}
+	defer f.Close()
+
+	exitCode, err := cfg.RunProcess(fmt.Sprintf("sh -c 'cat > %s'", guestPath), f, ioutil.Discard, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("run process: %s", err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("copy to guest exited %d", exitCode)
+	}
+	return nil
+}
+
+// copyFileFromGuest is copyFileToGuest's mirror: it reads guestPath inside
+// the utility VM and writes the bytes to hostPath.
+func copyFileFromGuest(cfg *opengcs.Config, guestPath, hostPath string) error {
+	out, err := os.Create(hostPath)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", hostPath, err)
+	}
+	defer out.Close()
+
+	exitCode, err := cfg.RunProcess(fmt.Sprintf("cat %s", guestPath), nil, out, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("run process: %s", err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("copy from guest exited %d", exitCode)
+	}
+	return nil
+}
+
+// snapshotStats runs a small diagnostic command inside the guest and logs
+// its output under name, standing in for the per-step memory/disk snapshot
+// the plan asks for since opengcs.Config has no stats call of its own.
+func snapshotStats(cfg *opengcs.Config, name string) error {
+	var stdout bytes.Buffer
+	exitCode, err := cfg.RunProcess("sh -c 'cat /proc/meminfo; echo; df -h'", nil, &stdout, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("run process: %s", err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("snapshot exited %d", exitCode)
+	}
+	logrus.Infof("step %q stats:\n%s", name, stdout.String())
+	return nil
+}
+
+// anyFailed reports whether any result in results has a non-nil Err.
+func anyFailed(results []StepResult) bool {
+	for _, r := range results {
+		if r.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// junitTestSuite and junitTestCase are the subset of the JUnit XML schema
+// that CI systems care about: pass/fail per test case, with a failure
+// message when one failed.
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes results as a JUnit XML report to path, for consumption
+// by a CI job.
+func writeJUnit(path string, results []StepResult) error {
+	suite := junitTestSuite{Name: "opengcs-plan", Tests: len(results)}
+	for _, r := range results {
+		tc := junitTestCase{Name: r.Name, ClassName: "opengcs-plan", Time: r.Duration.Seconds()}
+		if r.Err != nil {
+			suite.Failures++
+			tc.Failure = &junitFailure{Message: r.Err.Error(), Text: r.Err.Error()}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,127 @@
+package main
+
+// -run-sparsefile drives the sparsefile workload (see ../files/sparsefile.go)
+// end to end inside and around a utility VM: it attaches a scratch VHD,
+// copies a linux/amd64 sparsefile binary into the guest and runs the write
+// workload there, copies the resulting manifest back, then boots a second,
+// throwaway utility VM that mounts the same VHD read-only and replays the
+// manifest with "-verify-from" to catch any divergence between what the
+// guest wrote and what a fresh mount of the same disk reads back.
+
+import (
+	"fmt"
+	"strings"
+
+	opengcs "github.com/Microsoft/opengcs/client"
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sparsefileGuestBinary   = "/tmp/sparsefile"
+	sparsefileGuestManifest = "/tmp/sparsefile.manifest"
+)
+
+// sparsefileRunOpts configures one end-to-end sparsefile run.
+type sparsefileRunOpts struct {
+	ScratchVHDPath string   // host path to the scratch VHD to attach
+	BinaryPath     string   // host path to a linux/amd64 build of sparsefile
+	ManifestPath   string   // host path to copy the write run's manifest to
+	GuestDiskPath  string   // block device path inside the guest for the attached VHD
+	ExtraArgs      []string // extra arguments forwarded to the guest sparsefile invocation
+}
+
+// runSparsefileIntegration attaches opts.ScratchVHDPath to cfg's utility VM,
+// runs the sparsefile write workload inside it, and re-verifies the result
+// from a second utility VM that mounts the same VHD read-only.
+func runSparsefileIntegration(cfg *opengcs.Config, opts sparsefileRunOpts) error {
+	logrus.Info("Attaching scratch VHD for sparsefile workload")
+	if err := cfg.HotAddVhd(opts.ScratchVHDPath, 0, 1, false); err != nil {
+		return fmt.Errorf("attach scratch vhd: %s", err)
+	}
+
+	if err := copyAndRunSparsefile(cfg, opts.BinaryPath, append([]string{
+		"-file=" + opts.GuestDiskPath,
+		"-manifest=" + sparsefileGuestManifest,
+	}, opts.ExtraArgs...)); err != nil {
+		return fmt.Errorf("run sparsefile workload: %s", err)
+	}
+
+	logrus.Info("Copying manifest back from the utility VM")
+	if err := copyFileFromGuest(cfg, sparsefileGuestManifest, opts.ManifestPath); err != nil {
+		return fmt.Errorf("copy manifest from guest: %s", err)
+	}
+
+	// The VHD can only be attached read-write to one UVM at a time. Detach
+	// it here before reverifySparsefile attaches it (read-only) to a second
+	// one, or the second attach fails as a sharing violation.
+	logrus.Info("Detaching scratch VHD from the write VM")
+	if err := cfg.HotRemoveVhd(opts.ScratchVHDPath); err != nil {
+		return fmt.Errorf("detach scratch vhd: %s", err)
+	}
+
+	return reverifySparsefile(opts)
+}
+
+// reverifySparsefile boots a second, throwaway utility VM that mounts
+// opts.ScratchVHDPath read-only and checks it against the manifest the
+// write run produced, catching guest/host sparse-file divergence that
+// re-checking from the same VM and mount could miss.
+func reverifySparsefile(opts sparsefileRunOpts) error {
+	verifyCfg := &opengcs.Config{}
+	if err := verifyCfg.GenerateDefault(nil); err != nil {
+		return fmt.Errorf("generate verify vm config: %s", err)
+	}
+	verifyCfg.Name = "sparsefile-verify-" + uuid.NewV4().String()
+	if err := verifyCfg.Validate(); err != nil {
+		return fmt.Errorf("validate verify vm config: %s", err)
+	}
+
+	logrus.Info("Starting a fresh utility VM to re-verify the scratch VHD")
+	if err := verifyCfg.StartUtilityVM(); err != nil {
+		return fmt.Errorf("start verify vm: %s", err)
+	}
+	if err := verifyCfg.HotAddVhd(opts.ScratchVHDPath, 0, 1, true); err != nil {
+		return fmt.Errorf("attach scratch vhd read-only: %s", err)
+	}
+
+	if err := copyFileToGuest(verifyCfg, opts.ManifestPath, sparsefileGuestManifest); err != nil {
+		return fmt.Errorf("copy manifest to verify vm: %s", err)
+	}
+
+	return copyAndRunSparsefile(verifyCfg, opts.BinaryPath, []string{
+		"-file=" + opts.GuestDiskPath,
+		"-verify-from=" + sparsefileGuestManifest,
+	})
+}
+
+// copyAndRunSparsefile copies the sparsefile binary at hostBinaryPath into
+// cfg's utility VM and runs it there with args, returning an error if the
+// copy, chmod, or the workload itself fails.
+func copyAndRunSparsefile(cfg *opengcs.Config, hostBinaryPath string, args []string) error {
+	logrus.Info("Copying sparsefile binary into the utility VM")
+	if err := copyFileToGuest(cfg, hostBinaryPath, sparsefileGuestBinary); err != nil {
+		return fmt.Errorf("copy sparsefile binary: %s", err)
+	}
+	if err := runProcessAndCheck(cfg, "chmod +x "+sparsefileGuestBinary); err != nil {
+		return fmt.Errorf("chmod sparsefile binary: %s", err)
+	}
+
+	command := append([]string{sparsefileGuestBinary}, args...)
+	logrus.Infof("Running in guest: %v", command)
+	return runProcessAndCheck(cfg, strings.Join(command, " "))
+}
+
+// runProcessAndCheck runs commandLine inside cfg's utility VM over the GCS
+// process protocol and returns an error if it fails to start or exits
+// non-zero.
+func runProcessAndCheck(cfg *opengcs.Config, commandLine string) error {
+	exitCode, err := cfg.RunProcess(commandLine, nil, logrus.StandardLogger().Out, logrus.StandardLogger().Out)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("%q exited %d", commandLine, exitCode)
+	}
+	return nil
+}